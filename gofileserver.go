@@ -1,32 +1,97 @@
 package main
 
 import (
-    "bytes"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "io/ioutil"
     "log"
     "net/http"
+    "net/url"
     "strconv"
+    "strings"
+    "time"
 
     "github.com/gorilla/mux"
 
     "rpm/gofileserver/internal/auth"
+    "rpm/gofileserver/internal/buckets"
     "rpm/gofileserver/internal/files"
+    "rpm/gofileserver/internal/vault"
 )
 
 
 const MAX_JSON_PAYLOAD = 1024
 const MAX_FILE_UPLOAD = 1024*1024
 
+// Vault blobs are small (a scrypt check value plus a wrapped master key), so
+// this is generous headroom rather than a real capacity limit.
+const MAX_VAULT_BLOB = 64 * 1024
+
+// Default lifetime, in seconds, given to a presigned URL when the caller
+// doesn't specify one. Capped at auth.MAX_PRESIGN_WINDOW.
+const DEFAULT_PRESIGN_EXPIRY = 300
+
+// How often the background token janitor sweeps for expired tokens.
+const TOKEN_JANITOR_INTERVAL = 1 * time.Hour
+
 
 type ErrorResponse struct {
     Error  string  `json:"error"`
 }
 
 type LoginResponse struct {
-    AccessToken  string  `json:"token"`
+    AccessToken   string  `json:"token"`
+    RefreshToken  string  `json:"refreshToken,omitempty"`
+}
+
+type RefreshRequest struct {
+    RefreshToken  string  `json:"refreshToken"`
+}
+
+type PresignRequest struct {
+    Scope      string  `json:"scope"`      // "GET", "PUT", or "GET+PUT"
+    ExpiresIn  int64   `json:"expiresIn"`   // seconds, optional
+}
+
+type PresignResponse struct {
+    URL      string  `json:"url"`
+    Expire   int64   `json:"expire"`
+}
+
+type CreateUploadResponse struct {
+    UploadID     string  `json:"uploadID"`
+    MaxPartSize  int     `json:"maxPartSize"`
+}
+
+type PutPartResponse struct {
+    SHA256  string  `json:"sha256"`
+}
+
+type CompleteUploadRequest struct {
+    Parts  []files.PartSpec  `json:"parts"`
+}
+
+type CreateBucketRequest struct {
+    Name  string  `json:"name"`
+}
+
+type BucketResponse struct {
+    ID       string  `json:"id"`
+    Name     string  `json:"name"`
+    OwnerID  string  `json:"ownerID"`
+}
+
+// Body of a PUT /buckets/{name}/acl request: maps a userID to an ACL string
+// built from the letters "r" and/or "w" (e.g. "r", "w", "rw", or "" to revoke
+// all access).
+type SetACLRequest map[string]string
+
+// Response body of a 409 Conflict from a version-checked file PUT, carrying
+// the file's actual current version so the client can merge and retry.
+type VersionConflictResponse struct {
+    CurrentVersion  string  `json:"currentVersion"`
 }
 
 
@@ -39,9 +104,23 @@ func main() {
     router.Methods("POST").Path("/register").HandlerFunc(doRegister)
 
     router.Methods("POST").Path("/login").HandlerFunc(doLogin)
+    router.Methods("POST").Path("/refresh").HandlerFunc(doRefresh)
+    router.Methods("POST").Path("/logout").HandlerFunc(doLogout)
+
+    router.Methods("POST").Path("/buckets").HandlerFunc(doBucketsCreate)
+    router.Methods("GET").Path("/buckets").HandlerFunc(doBucketsList)
+    router.Methods("PUT").Path("/buckets/{name}/acl").HandlerFunc(doBucketsSetACL)
+
+    router.Methods("POST").Path("/vault/init").HandlerFunc(doVaultInit)
+    router.Methods("GET").Path("/vault").HandlerFunc(doVaultGet)
+
+    // registered ahead of the generic /files prefix handler below so it takes priority
+    router.Methods("POST").Path("/files/{bucket}/{path:.*}/presign").HandlerFunc(doFilesPresign)
 
     router.PathPrefix("/files").Handler(http.StripPrefix("/files", http.HandlerFunc(doFiles)))
 
+    auth.StartTokenJanitor(TOKEN_JANITOR_INTERVAL)
+
     log.Fatal(http.ListenAndServe(":8080", router))
 }
 
@@ -111,7 +190,7 @@ func doRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// Login a user, returning an authentication token for later calls.
+// Login a user, returning an access/refresh token pair for later calls.
 func doLogin(w http.ResponseWriter, r *http.Request) {
 
     var user auth.User
@@ -119,7 +198,25 @@ func doLogin(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    accessToken, err := auth.Login(&user)
+    accessToken, refreshToken, err := auth.Login(&user)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusForbidden, err.Error())
+        return
+    }
+
+    jsonResponse(w, http.StatusOK, &LoginResponse{AccessToken: accessToken, RefreshToken: refreshToken})
+}
+
+
+// Exchanges a refresh token for a new access token.
+func doRefresh(w http.ResponseWriter, r *http.Request) {
+
+    var refreshReq RefreshRequest
+    if err := parseJsonBody(w, r, &refreshReq); err != nil {
+        return
+    }
+
+    accessToken, err := auth.RefreshAccessToken(refreshReq.RefreshToken)
     if err != nil {
         jsonErrorResponse(w, http.StatusForbidden, err.Error())
         return
@@ -129,7 +226,64 @@ func doLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// Dispatches file requests for a given user, determined by the authentication token.
+// Logs out the session identified by the X-Session header.
+func doLogout(w http.ResponseWriter, r *http.Request) {
+
+    if err := auth.Logout(r.Header.Get("X-Session")); err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    jsonResponse(w, http.StatusNoContent, nil)
+}
+
+
+// Returns the ACL bit(s) that the given HTTP method requires on a bucket.
+// POST (multi-part upload create/complete) counts as a write. Any other method
+// maps to no bits, so the ACL check in doFiles refuses it with 403.
+func aclForMethod(method string) buckets.ACL {
+    switch method {
+    case "GET":
+        return buckets.ACLRead
+    case "PUT", "POST", "DELETE":
+        return buckets.ACLWrite
+    default:
+        return 0
+    }
+}
+
+
+// Parses an ACL string made of the letters "r" and/or "w" (in any order/case)
+// into its bit-flag form. An empty string parses to 0 (no access).
+func parseACL(s string) (buckets.ACL, error) {
+    var acl buckets.ACL
+    for _, c := range strings.ToLower(s) {
+        switch c {
+        case 'r':
+            acl |= buckets.ACLRead
+        case 'w':
+            acl |= buckets.ACLWrite
+        default:
+            return 0, errors.New("acl must only contain the letters 'r' and 'w'")
+        }
+    }
+    return acl, nil
+}
+
+
+// Resolves a bucket by name, auto-provisioning the caller's default private
+// bucket (whose name equals their userID) the first time they address it.
+func resolveBucket(name string, requesterID string) (*buckets.Bucket, error) {
+    if name == requesterID {
+        return buckets.EnsureDefaultBucket(requesterID)
+    }
+    return buckets.GetBucket(name)
+}
+
+
+// Dispatches file requests for a given bucket, determined by the authentication
+// token, or by a presigned URL (query params sig/expire) if no session header
+// is present. Requires the caller to hold the ACL bit the HTTP method needs.
 func doFiles(w http.ResponseWriter, r *http.Request) {
 
     path := r.URL.Path
@@ -139,27 +293,97 @@ func doFiles(w http.ResponseWriter, r *http.Request) {
         path = path[1:]
     }
 
-    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
-    if err != nil {
-        w.WriteHeader(http.StatusForbidden) // 403
+    bucketName, path, ok := splitBucketPath(path)
+    if !ok {
+        w.WriteHeader(http.StatusNotFound) // 404
         return
     }
 
+    var bucketID string
+
+    sig := r.URL.Query().Get("sig")
+    expireParam := r.URL.Query().Get("expire")
+
+    if r.Header.Get("X-Session") == "" && sig != "" && expireParam != "" {
+        // presigned request: already scoped to bucketName/path at signing time
+        expireUnix, err := strconv.ParseInt(expireParam, 10, 64)
+        if err != nil {
+            w.WriteHeader(http.StatusForbidden) // 403
+            return
+        }
+
+        if err := auth.VerifyPresignedRequest(r.Method, bucketName, path, sig, expireUnix); err != nil {
+            w.WriteHeader(http.StatusForbidden) // 403
+            return
+        }
+
+        bucket, err := buckets.GetBucket(bucketName)
+        if err != nil {
+            w.WriteHeader(http.StatusNotFound) // 404
+            return
+        }
+        bucketID = bucket.ID
+    } else {
+        userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+        if err != nil {
+            w.WriteHeader(http.StatusForbidden) // 403
+            return
+        }
+
+        bucket, err := resolveBucket(bucketName, userID)
+        if err != nil {
+            w.WriteHeader(http.StatusNotFound) // 404
+            return
+        }
+
+        if buckets.EffectiveACL(bucket, userID)&aclForMethod(r.Method) == 0 {
+            w.WriteHeader(http.StatusForbidden) // 403
+            return
+        }
+
+        bucketID = bucket.ID
+    }
+
+    query := r.URL.Query()
+    uploadID := query.Get("uploadID")
+
     // dispatch based on method
     if r.Method == "GET" {
         if path == "" {
-            doFilesList(userID, w, r)
+            doFilesList(bucketID, w, r)
             return
         }
-        doFilesGet(userID, path, w, r)
+        doFilesGet(bucketID, path, w, r)
+        return
+    }
+    if r.Method == "POST" {
+        if _, present := query["uploads"]; present {
+            doFilesCreateUpload(bucketID, path, w, r)
+            return
+        }
+        if uploadID != "" {
+            if _, present := query["complete"]; present {
+                doFilesCompleteUpload(bucketID, uploadID, w, r)
+                return
+            }
+        }
+        w.WriteHeader(http.StatusMethodNotAllowed) // 405
         return
     }
     if r.Method == "PUT" {
-        doFilesPut(userID, path, w, r)
+        if uploadID != "" {
+            doFilesPutPart(bucketID, uploadID, query.Get("partNumber"), w, r)
+            return
+        }
+        doFilesPut(bucketID, path, w, r)
         return
     }
     if r.Method == "DELETE" {
-        doFilesDelete(userID, path, w, r)
+        if uploadID != "" {
+            doFilesAbortUpload(bucketID, uploadID, w, r)
+            return
+        }
+        doFilesDelete(bucketID, path, w, r)
         return
     }
 
@@ -167,36 +391,171 @@ func doFiles(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// Return the list of files, as an array of string filenames, for the user.
-func doFilesList(userID string, w http.ResponseWriter, r *http.Request) {
+// Splits a request path of the form "{bucket}/{path}" into its two parts. The
+// file path may be empty (bucket name with no remainder, e.g. "{bucket}" or
+// "{bucket}/"), which doFiles routes to doFilesList. Returns ok=false if the
+// path doesn't even carry a bucket name.
+func splitBucketPath(path string) (bucket string, filename string, ok bool) {
+    parts := strings.SplitN(path, "/", 2)
+    if parts[0] == "" {
+        return "", "", false
+    }
+    if len(parts) == 1 {
+        return parts[0], "", true
+    }
+    return parts[0], parts[1], true
+}
+
+
+// Issues a presigned URL granting time-limited, tokenless access to a single file
+// in a bucket. The caller must hold the ACL bit(s) the requested scope implies.
+func doFilesPresign(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    vars := mux.Vars(r)
+    bucketName := vars["bucket"]
+    path := vars["path"]
+
+    bucket, err := resolveBucket(bucketName, userID)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusNotFound, "bucket not found")
+        return
+    }
 
-    files := files.ListFilenames(userID)
+    var presignReq PresignRequest
+    if err := parseJsonBody(w, r, &presignReq); err != nil {
+        return
+    }
+
+    if presignReq.Scope != "GET" && presignReq.Scope != "PUT" && presignReq.Scope != "GET+PUT" {
+        jsonErrorResponse(w, http.StatusBadRequest, "scope must be GET, PUT, or GET+PUT")
+        return
+    }
+
+    var requiredACL buckets.ACL
+    if presignReq.Scope == "GET" || presignReq.Scope == "GET+PUT" {
+        requiredACL |= buckets.ACLRead
+    }
+    if presignReq.Scope == "PUT" || presignReq.Scope == "GET+PUT" {
+        requiredACL |= buckets.ACLWrite
+    }
+    if buckets.EffectiveACL(bucket, userID)&requiredACL != requiredACL {
+        jsonErrorResponse(w, http.StatusForbidden, "insufficient access to presign this scope")
+        return
+    }
+
+    expiresIn := presignReq.ExpiresIn
+    if expiresIn <= 0 {
+        expiresIn = DEFAULT_PRESIGN_EXPIRY
+    }
+    if expiresIn > auth.MAX_PRESIGN_WINDOW {
+        expiresIn = auth.MAX_PRESIGN_WINDOW
+    }
+
+    expireUnix := time.Now().Unix() + expiresIn
+
+    sig := auth.SignPresignedRequest(presignReq.Scope, bucket.Name, path, expireUnix)
+
+    presignedURL := fmt.Sprintf("/files/%s/%s?sig=%s&expire=%d", bucket.Name, path, url.QueryEscape(sig), expireUnix)
+
+    jsonResponse(w, http.StatusOK, &PresignResponse{URL: presignedURL, Expire: expireUnix})
+}
+
+
+// Return the list of files, as an array of string filenames, in the bucket.
+func doFilesList(bucketID string, w http.ResponseWriter, r *http.Request) {
+
+    files := files.ListFilenames(bucketID)
 
     jsonResponse(w, http.StatusOK, &files)
 }
 
 
-// Return the body of the given file.
-func doFilesGet(userID string, path string, w http.ResponseWriter, r *http.Request) {
+// Parses a single-range "Range: bytes=a-b" header against a resource of the given
+// total length. isRange is false (and start/end are meaningless) if the header is
+// absent or malformed, in which case the whole resource should be served.
+func parseRangeHeader(rangeHeader string, contentLength int) (start int, end int, isRange bool) {
+
+    if rangeHeader == "" || !strings.HasPrefix(rangeHeader, "bytes=") {
+        return 0, 0, false
+    }
+
+    bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+    if len(bounds) != 2 {
+        return 0, 0, false
+    }
+
+    parsedStart, err := strconv.Atoi(bounds[0])
+    if err != nil || parsedStart < 0 || parsedStart >= contentLength {
+        return 0, 0, false
+    }
 
-    fileBytes, contentType, present := files.GetFile(userID, path)
+    parsedEnd := contentLength - 1
+    if bounds[1] != "" {
+        if n, err := strconv.Atoi(bounds[1]); err == nil && n < parsedEnd {
+            parsedEnd = n
+        }
+    }
 
+    if parsedEnd < parsedStart {
+        return 0, 0, false
+    }
+
+    return parsedStart, parsedEnd, true
+}
+
+
+// Return the body of the given file, honoring Range and If-None-Match requests.
+func doFilesGet(bucketID string, path string, w http.ResponseWriter, r *http.Request) {
+
+    reader, metadata, present := files.GetFile(bucketID, path)
     if !present {
         jsonResponse(w, http.StatusNotFound, nil)
         return
     }
+    defer reader.Close()
 
-    // NOTE: Content-Length is set automatically
+    etag := "\"" + metadata.SHA256 + "\""
 
-    w.Header().Set("Content-Type", contentType)
-    w.WriteHeader(http.StatusOK) // 200
+    w.Header().Set("Content-Type", metadata.ContentType)
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("ETag", etag)
+    w.Header().Set("X-Version", metadata.Version)
 
-    io.Copy(w, bytes.NewReader(fileBytes))
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified) // 304
+        return
+    }
+
+    start, end, isRange := parseRangeHeader(r.Header.Get("Range"), metadata.ContentLength)
+    if !isRange {
+        w.Header().Set("Content-Length", strconv.Itoa(metadata.ContentLength))
+        w.WriteHeader(http.StatusOK) // 200
+        io.Copy(w, reader)
+        return
+    }
+
+    if _, err := reader.Seek(int64(start), io.SeekStart); err != nil {
+        jsonErrorResponse(w, http.StatusInternalServerError, "Failed seeking file")
+        return
+    }
+
+    w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, metadata.ContentLength))
+    w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+    w.WriteHeader(http.StatusPartialContent) // 206
+    io.CopyN(w, reader, int64(end-start+1))
 }
 
 
 // Upload a file into a user's space, possibly overwriting an existing file with the same path.
-func doFilesPut(userID string, path string, w http.ResponseWriter, r *http.Request) {
+// If X-Prev-Version is set, the write is rejected with 409 Conflict unless it matches the
+// file's current stored version (optimistic concurrency for the encrypted-vault mode).
+func doFilesPut(bucketID string, path string, w http.ResponseWriter, r *http.Request) {
 
     contentType := r.Header.Get("Content-Type")
 
@@ -214,9 +573,17 @@ func doFilesPut(userID string, path string, w http.ResponseWriter, r *http.Reque
         return
     }
 
-    bodyBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_FILE_UPLOAD))
+    encrypted, _ := strconv.ParseBool(r.Header.Get("X-Encrypted"))
+    prevVersion := r.Header.Get("X-Prev-Version")
+
+    written, version, err := files.PutFile(bucketID, path, contentType, io.LimitReader(r.Body, int64(contentLength)), encrypted, prevVersion)
     if err != nil {
-        jsonErrorResponse(w, http.StatusBadRequest, "Failed reading file upload")
+        var conflict *files.VersionConflictError
+        if errors.As(err, &conflict) {
+            jsonResponse(w, http.StatusConflict, &VersionConflictResponse{CurrentVersion: conflict.CurrentVersion}) // 409
+            return
+        }
+        jsonErrorResponse(w, http.StatusBadRequest, "Failed saving file")
         return
     }
     if err := r.Body.Close(); err != nil {
@@ -224,13 +591,101 @@ func doFilesPut(userID string, path string, w http.ResponseWriter, r *http.Reque
         return
     }
 
-    if contentLength != len(bodyBytes) {
+    if written != contentLength {
         jsonErrorResponse(w, http.StatusBadRequest, "Content-Length does not match uploaded file")
         return
     }
 
-    if err := files.PutFile(userID, path, contentType, bodyBytes); err != nil {
-        jsonErrorResponse(w, http.StatusBadRequest, "Failed saving file")
+    w.Header().Set("X-Version", version)
+    jsonResponse(w, http.StatusCreated, nil)
+}
+
+
+// Delete the given file for the user.
+func doFilesDelete(bucketID string, path string, w http.ResponseWriter, r *http.Request) {
+
+    if err := files.DeleteFile(bucketID, path); err != nil {
+        jsonErrorResponse(w, http.StatusNotFound, "file not found")
+        return
+    }
+
+    jsonResponse(w, http.StatusNoContent, nil)
+}
+
+
+
+// Begins a new resumable, multi-part upload for a file in the user's space.
+func doFilesCreateUpload(bucketID string, path string, w http.ResponseWriter, r *http.Request) {
+
+    contentType := r.Header.Get("Content-Type")
+
+    uploadID, err := files.CreateUploadSession(bucketID, path, contentType)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, "Failed creating upload session")
+        return
+    }
+
+    jsonResponse(w, http.StatusOK, &CreateUploadResponse{
+        UploadID:    uploadID,
+        MaxPartSize: files.MAX_PART_UPLOAD,
+    })
+}
+
+
+// Streams a single part of an in-progress upload into the files package.
+func doFilesPutPart(bucketID string, uploadID string, partNumberParam string, w http.ResponseWriter, r *http.Request) {
+
+    partNumber, err := strconv.Atoi(partNumberParam)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, "partNumber required")
+        return
+    }
+
+    contentLength, err := strconv.Atoi(r.Header.Get("Content-Length"))
+    if err != nil || contentLength == 0 {
+        jsonErrorResponse(w, http.StatusBadRequest, "Content-Length required")
+        return
+    }
+    if contentLength > files.MAX_PART_UPLOAD {
+        jsonErrorResponse(w, http.StatusBadRequest, "Content-Length exceeds maximum part size")
+        return
+    }
+
+    bodyBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(files.MAX_PART_UPLOAD)))
+    if err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, "Failed reading part upload")
+        return
+    }
+    if err := r.Body.Close(); err != nil {
+        jsonErrorResponse(w, http.StatusInternalServerError, "Failed closing body")
+        return
+    }
+
+    if contentLength != len(bodyBytes) {
+        jsonErrorResponse(w, http.StatusBadRequest, "Content-Length does not match uploaded part")
+        return
+    }
+
+    sha256Hex, err := files.PutPart(bucketID, uploadID, partNumber, bodyBytes)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    jsonResponse(w, http.StatusOK, &PutPartResponse{SHA256: sha256Hex})
+}
+
+
+// Completes an in-progress upload, assembling the uploaded parts into the final file.
+func doFilesCompleteUpload(bucketID string, uploadID string, w http.ResponseWriter, r *http.Request) {
+
+    var completeReq CompleteUploadRequest
+    if err := parseJsonBody(w, r, &completeReq); err != nil {
+        return
+    }
+
+    if err := files.CompleteUpload(bucketID, uploadID, completeReq.Parts); err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, err.Error())
         return
     }
 
@@ -238,14 +693,143 @@ func doFilesPut(userID string, path string, w http.ResponseWriter, r *http.Reque
 }
 
 
-// Delete the given file for the user.
-func doFilesDelete(userID string, path string, w http.ResponseWriter, r *http.Request) {
+// Aborts an in-progress upload, discarding any parts uploaded so far.
+func doFilesAbortUpload(bucketID string, uploadID string, w http.ResponseWriter, r *http.Request) {
 
-    if err := files.DeleteFile(userID, path); err != nil {
-        jsonErrorResponse(w, http.StatusNotFound, "file not found")
+    if err := files.AbortUpload(bucketID, uploadID); err != nil {
+        jsonErrorResponse(w, http.StatusNotFound, "upload session not found")
+        return
+    }
+
+    jsonResponse(w, http.StatusNoContent, nil)
+}
+
+
+// Creates a new bucket, owned by the authenticated user.
+func doBucketsCreate(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    var createReq CreateBucketRequest
+    if err := parseJsonBody(w, r, &createReq); err != nil {
         return
     }
 
+    bucket, err := buckets.CreateBucket(createReq.Name, userID)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    jsonResponse(w, http.StatusCreated, &BucketResponse{ID: bucket.ID, Name: bucket.Name, OwnerID: bucket.OwnerID})
+}
+
+
+// Lists the buckets the authenticated user owns or has been granted access to.
+func doBucketsList(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    userBuckets, err := buckets.ListBucketsForUser(userID)
+    if err != nil {
+        jsonErrorResponse(w, http.StatusInternalServerError, "Failed listing buckets")
+        return
+    }
+
+    response := make([]BucketResponse, len(userBuckets))
+    for i, bucket := range userBuckets {
+        response[i] = BucketResponse{ID: bucket.ID, Name: bucket.Name, OwnerID: bucket.OwnerID}
+    }
+
+    jsonResponse(w, http.StatusOK, &response)
+}
+
+
+// Grants or revokes other users' access to a bucket. Only the bucket's owner may call this.
+func doBucketsSetACL(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    bucketName := mux.Vars(r)["name"]
+
+    var setACLReq SetACLRequest
+    if err := parseJsonBody(w, r, &setACLReq); err != nil {
+        return
+    }
+
+    for granteeID, aclStr := range setACLReq {
+        acl, err := parseACL(aclStr)
+        if err != nil {
+            jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        if err := buckets.SetGrant(bucketName, userID, granteeID, acl); err != nil {
+            jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+            return
+        }
+    }
+
     jsonResponse(w, http.StatusNoContent, nil)
 }
 
+
+// Stores (or overwrites) the authenticated user's vault blob: an opaque,
+// client-encrypted key-wrapping payload. The server never inspects its contents.
+func doVaultInit(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    blob, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_VAULT_BLOB))
+    if err != nil {
+        jsonErrorResponse(w, http.StatusInternalServerError, "Failed reading request body")
+        return
+    }
+    if err := r.Body.Close(); err != nil {
+        jsonErrorResponse(w, http.StatusInternalServerError, "Failed closing request body")
+        return
+    }
+
+    if err := vault.InitVault(userID, blob); err != nil {
+        jsonErrorResponse(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    jsonResponse(w, http.StatusNoContent, nil)
+}
+
+
+// Returns the authenticated user's vault blob.
+func doVaultGet(w http.ResponseWriter, r *http.Request) {
+
+    userID, err := auth.ValidateToken(r.Header.Get("X-Session"))
+    if err != nil {
+        w.WriteHeader(http.StatusForbidden) // 403
+        return
+    }
+
+    blob, err := vault.GetVault(userID)
+    if err != nil {
+        jsonResponse(w, http.StatusNotFound, nil)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.WriteHeader(http.StatusOK)
+    w.Write(blob)
+}
@@ -1,15 +1,22 @@
 package auth
 
 import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
     "crypto/sha256"
     "errors"
+    "encoding/base64"
     "encoding/hex"
     "encoding/json"
     "fmt"
+    "os"
     "regexp"
+    "strconv"
     "time"
-    
+
     "github.com/google/uuid"
+    "golang.org/x/crypto/bcrypt"
 
     bolt "github.com/coreos/bbolt"
 )
@@ -18,6 +25,24 @@ import (
 const DB_NAME = "gofileserver_auth.db"
 const USER_BUCKET = "UserBucket"
 const TOKEN_BUCKET = "TokenBucket"
+const REFRESH_BUCKET = "RefreshBucket"
+
+// Presigned URLs may not be issued for longer than this many seconds.
+const MAX_PRESIGN_WINDOW = 900
+
+// Environment variable holding the server's HMAC signing secret for presigned URLs.
+// If unset, a random secret is generated at startup (existing presigned URLs
+// will stop validating across restarts).
+const SIGNING_SECRET_ENV = "GOFILESERVER_SIGNING_SECRET"
+
+// Environment variable overriding the bcrypt cost factor used for new password hashes.
+const BCRYPT_COST_ENV = "GOFILESERVER_BCRYPT_COST"
+
+const DEFAULT_BCRYPT_COST = 12
+
+// Lifetimes of access and refresh tokens.
+const ACCESS_TOKEN_TTL = 24 * time.Hour
+const REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
 
 
 type User struct {
@@ -27,9 +52,48 @@ type User struct {
 }
 
 type Token struct {
-    AccessToken  string     `json:"token"`
-    UserID       string     `json:"user"`
-    Created      time.Time  `json:"created"`
+    AccessToken   string     `json:"token"`
+    RefreshToken  string     `json:"refreshToken"`
+    UserID        string     `json:"user"`
+    Created       time.Time  `json:"created"`
+}
+
+// Tracks the lifetime of a refresh token independently of the access tokens
+// it has been exchanged for, keyed by the refresh token itself.
+type refreshRecord struct {
+    UserID   string     `json:"user"`
+    Created  time.Time  `json:"created"`
+}
+
+
+// Per-server secret used to HMAC-sign presigned URLs. Populated at startup.
+var signingSecret []byte
+
+// bcrypt cost factor used when hashing new passwords.
+var bcryptCost = DEFAULT_BCRYPT_COST
+
+// hex-encoded SHA256 digests are exactly 64 lowercase hex characters; bcrypt
+// hashes always start with "$2". Used to detect pre-bcrypt password records.
+var legacySHA256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+
+func init() {
+
+    // Load (or generate) the secret used to sign presigned URLs.
+    if secret := os.Getenv(SIGNING_SECRET_ENV); secret != "" {
+        signingSecret = []byte(secret)
+    } else {
+        signingSecret = make([]byte, 32)
+        if _, err := rand.Read(signingSecret); err != nil {
+            panic(err)
+        }
+    }
+
+    if costStr := os.Getenv(BCRYPT_COST_ENV); costStr != "" {
+        if cost, err := strconv.Atoi(costStr); err == nil {
+            bcryptCost = cost
+        }
+    }
 }
 
 
@@ -60,6 +124,11 @@ func init() {
         panic(err)
     }
 
+    _, err = tx.CreateBucketIfNotExists([]byte(REFRESH_BUCKET))
+    if err != nil {
+        panic(err)
+    }
+
     if err = tx.Commit(); err != nil {
         panic(err)
     }
@@ -68,9 +137,19 @@ func init() {
 }
 
 
+// Helper function that computes a bcrypt hash for a password, at bcryptCost.
+func hashPassword(password string) (string, error) {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+    if err != nil {
+        return "", err
+    }
+    return string(hash), nil
+}
+
+
 // Helper function that computes the hex-encoded SHA256 value for a password.
-func hashPassword(password string) string {
-    //TODO: hash password with salt?
+// Retained only to verify legacy (pre-bcrypt) password records on login.
+func legacyHashPassword(password string) string {
     sum := sha256.Sum256([]byte(password))
     return hex.EncodeToString(sum[:])
 }
@@ -115,7 +194,11 @@ func CreateUser(user *User) error {
         user.ID = uuid.New().String()
 
         // hash password (NOTE this will modify the user object passed in)
-        user.Password = hashPassword(user.Password)
+        hashedPassword, err := hashPassword(user.Password)
+        if err != nil {
+            return err
+        }
+        user.Password = hashedPassword
 
         // encode to JSON
         encoded, err := json.Marshal(user)
@@ -133,8 +216,8 @@ func CreateUser(user *User) error {
 }
 
 
-// Login a user, generating a token for the session.
-func Login(user *User) (accessToken string, err error) {
+// Login a user, generating an access/refresh token pair for the session.
+func Login(user *User) (accessToken string, refreshToken string, err error) {
     fmt.Printf("Login...")
 
     db, err := bolt.Open(DB_NAME, 0600, nil)
@@ -145,7 +228,7 @@ func Login(user *User) (accessToken string, err error) {
 
     err = db.Update(func(tx *bolt.Tx) error {
         userBucket := tx.Bucket([]byte(USER_BUCKET))
-        
+
 
         //retrieve user from database
         v := userBucket.Get([]byte(user.Username))
@@ -158,17 +241,38 @@ func Login(user *User) (accessToken string, err error) {
             return errors.New("authentication failed (failed parsing JSON from database)")
         }
 
-        // compare hashed password
-        if dbUser.Password != hashPassword(user.Password) {
+        if legacySHA256Regex.MatchString(dbUser.Password) {
+            // legacy (pre-bcrypt) record: verify with the old scheme, then migrate
+            if dbUser.Password != legacyHashPassword(user.Password) {
+                return errors.New("authentication failed")
+            }
+
+            migratedPassword, err := hashPassword(user.Password)
+            if err != nil {
+                return err
+            }
+            dbUser.Password = migratedPassword
+
+            encodedUser, err := json.Marshal(&dbUser)
+            if err != nil {
+                return err
+            }
+            if err := userBucket.Put([]byte(user.Username), encodedUser); err != nil {
+                return err
+            }
+        } else if bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(user.Password)) != nil {
             return errors.New("authentication failed")
         }
 
+        now := time.Now()
         accessToken = uuid.New().String()
+        refreshToken = uuid.New().String()
 
         token := Token{
             AccessToken: accessToken,
+            RefreshToken: refreshToken,
             UserID: dbUser.ID,
-            Created: time.Now(),
+            Created: now,
         }
 
         // encode Token to JSON
@@ -179,16 +283,26 @@ func Login(user *User) (accessToken string, err error) {
 
         // store token in database
         tokenBucket := tx.Bucket([]byte(TOKEN_BUCKET))
-        err = tokenBucket.Put([]byte(accessToken), encodedToken)
+        if err := tokenBucket.Put([]byte(accessToken), encodedToken); err != nil {
+            return err
+        }
 
-        return err
+        // store the refresh token's own (longer-lived) record
+        record := refreshRecord{UserID: dbUser.ID, Created: now}
+        encodedRecord, err := json.Marshal(&record)
+        if err != nil {
+            return err
+        }
+        refreshBucket := tx.Bucket([]byte(REFRESH_BUCKET))
+        return refreshBucket.Put([]byte(refreshToken), encodedRecord)
     })
 
     if err != nil {
         accessToken = ""
+        refreshToken = ""
     }
 
-    return accessToken, err
+    return accessToken, refreshToken, err
 }
 
 
@@ -218,7 +332,9 @@ func ValidateToken(accessToken string) (userID string, err error) {
             return errors.New("invalid accessToken (failed parsing JSON from database)")
         }
 
-        //TODO: validate TTL of token
+        if time.Since(token.Created) > ACCESS_TOKEN_TTL {
+            return errors.New("accessToken expired")
+        }
 
         userID = token.UserID
 
@@ -232,3 +348,199 @@ func ValidateToken(accessToken string) (userID string, err error) {
     return userID, err
 }
 
+
+// Exchanges a still-valid refresh token for a new access token.
+func RefreshAccessToken(refreshToken string) (accessToken string, err error) {
+
+    if refreshToken == "" {
+        return "", errors.New("invalid refreshToken")
+    }
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        refreshBucket := tx.Bucket([]byte(REFRESH_BUCKET))
+
+        v := refreshBucket.Get([]byte(refreshToken))
+        if v == nil {
+            return errors.New("invalid refreshToken")
+        }
+
+        var record refreshRecord
+        if err := json.Unmarshal(v, &record); err != nil {
+            return errors.New("invalid refreshToken (failed parsing JSON from database)")
+        }
+
+        if time.Since(record.Created) > REFRESH_TOKEN_TTL {
+            refreshBucket.Delete([]byte(refreshToken))
+            return errors.New("refreshToken expired")
+        }
+
+        accessToken = uuid.New().String()
+
+        token := Token{
+            AccessToken: accessToken,
+            RefreshToken: refreshToken,
+            UserID: record.UserID,
+            Created: time.Now(),
+        }
+
+        encodedToken, err := json.Marshal(&token)
+        if err != nil {
+            return err
+        }
+
+        tokenBucket := tx.Bucket([]byte(TOKEN_BUCKET))
+        return tokenBucket.Put([]byte(accessToken), encodedToken)
+    })
+
+    if err != nil {
+        accessToken = ""
+    }
+
+    return accessToken, err
+}
+
+
+// Logs out a session by deleting its access token from TOKEN_BUCKET.
+func Logout(accessToken string) error {
+
+    if accessToken == "" {
+        return errors.New("invalid accessToken")
+    }
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(TOKEN_BUCKET))
+
+        if b.Get([]byte(accessToken)) == nil {
+            return errors.New("invalid accessToken")
+        }
+
+        return b.Delete([]byte(accessToken))
+    })
+}
+
+
+// StartTokenJanitor launches a background goroutine that periodically purges
+// expired access and refresh tokens. Intended to be called once at startup.
+func StartTokenJanitor(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        for range ticker.C {
+            purgeExpiredTokens()
+        }
+    }()
+}
+
+
+// Walks TOKEN_BUCKET and REFRESH_BUCKET, deleting any entries past their TTL.
+func purgeExpiredTokens() {
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        return
+    }
+    defer db.Close()
+
+    db.Update(func(tx *bolt.Tx) error {
+
+        tokenBucket := tx.Bucket([]byte(TOKEN_BUCKET))
+        expiredTokens := make([][]byte, 0)
+        tokenBucket.ForEach(func(k, v []byte) error {
+            var token Token
+            if err := json.Unmarshal(v, &token); err != nil {
+                return nil
+            }
+            if time.Since(token.Created) > ACCESS_TOKEN_TTL {
+                expiredTokens = append(expiredTokens, append([]byte(nil), k...))
+            }
+            return nil
+        })
+        for _, k := range expiredTokens {
+            tokenBucket.Delete(k)
+        }
+
+        refreshBucket := tx.Bucket([]byte(REFRESH_BUCKET))
+        expiredRefreshes := make([][]byte, 0)
+        refreshBucket.ForEach(func(k, v []byte) error {
+            var record refreshRecord
+            if err := json.Unmarshal(v, &record); err != nil {
+                return nil
+            }
+            if time.Since(record.Created) > REFRESH_TOKEN_TTL {
+                expiredRefreshes = append(expiredRefreshes, append([]byte(nil), k...))
+            }
+            return nil
+        })
+        for _, k := range expiredRefreshes {
+            refreshBucket.Delete(k)
+        }
+
+        return nil
+    })
+}
+
+
+// Builds the canonical string signed (and verified) for presigned file URLs.
+// scopeID identifies what the presigned URL is scoped to — the bucket name.
+func presignCanonicalString(scope string, scopeID string, filename string, expireUnix int64) []byte {
+    return []byte(fmt.Sprintf("%s\n%s\n%s\n%d\n", scope, scopeID, filename, expireUnix))
+}
+
+
+// Computes the base64-encoded HMAC-SHA1 signature for a presigned URL scoping
+// access to the given method (or "GET+PUT" for both) on a single file within
+// the bucket named bucketName, expiring at expireUnix (unix seconds).
+func SignPresignedRequest(scope string, bucketName string, filename string, expireUnix int64) string {
+    mac := hmac.New(sha1.New, signingSecret)
+    mac.Write(presignCanonicalString(scope, bucketName, filename, expireUnix))
+    return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+
+// Verifies a presigned URL's signature and expiry for the given method, bucketName and
+// filename. method must be either equal to the scope the URL was signed for, or the
+// scope must be "GET+PUT" (which authorizes both GET and PUT).
+func VerifyPresignedRequest(method string, bucketName string, filename string, sig string, expireUnix int64) error {
+
+    now := time.Now().Unix()
+
+    if expireUnix <= now {
+        return errors.New("presigned URL expired")
+    }
+    if expireUnix-now > MAX_PRESIGN_WINDOW {
+        return errors.New("presigned URL expiry too far in the future")
+    }
+
+    decodedSig, err := base64.StdEncoding.DecodeString(sig)
+    if err != nil {
+        return errors.New("invalid signature encoding")
+    }
+
+    if method != "GET" && method != "PUT" {
+        return errors.New("invalid signature")
+    }
+
+    candidates := []string{method, "GET+PUT"}
+
+    for _, scope := range candidates {
+        expected := hmac.New(sha1.New, signingSecret)
+        expected.Write(presignCanonicalString(scope, bucketName, filename, expireUnix))
+        if hmac.Equal(decodedSig, expected.Sum(nil)) {
+            return nil
+        }
+    }
+
+    return errors.New("invalid signature")
+}
+
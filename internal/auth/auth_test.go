@@ -0,0 +1,61 @@
+package auth
+
+import (
+    "testing"
+    "time"
+)
+
+func TestVerifyPresignedRequestAcceptsMatchingScope(t *testing.T) {
+    expireUnix := time.Now().Unix() + 60
+
+    sig := SignPresignedRequest("GET", "mybucket", "secret.txt", expireUnix)
+
+    if err := VerifyPresignedRequest("GET", "mybucket", "secret.txt", sig, expireUnix); err != nil {
+        t.Fatalf("expected matching GET scope to verify, got: %v", err)
+    }
+}
+
+func TestVerifyPresignedRequestAcceptsBothScopeForEitherMethod(t *testing.T) {
+    expireUnix := time.Now().Unix() + 60
+
+    sig := SignPresignedRequest("GET+PUT", "mybucket", "secret.txt", expireUnix)
+
+    if err := VerifyPresignedRequest("GET", "mybucket", "secret.txt", sig, expireUnix); err != nil {
+        t.Fatalf("expected GET+PUT scope to authorize GET, got: %v", err)
+    }
+    if err := VerifyPresignedRequest("PUT", "mybucket", "secret.txt", sig, expireUnix); err != nil {
+        t.Fatalf("expected GET+PUT scope to authorize PUT, got: %v", err)
+    }
+}
+
+func TestVerifyPresignedRequestRejectsNonGetPutMethod(t *testing.T) {
+    expireUnix := time.Now().Unix() + 60
+
+    // Signed for GET+PUT, so a naive "method or GET+PUT" check would wrongly
+    // let a DELETE through by recomputing the HMAC over the literal "GET+PUT".
+    sig := SignPresignedRequest("GET+PUT", "mybucket", "secret.txt", expireUnix)
+
+    if err := VerifyPresignedRequest("DELETE", "mybucket", "secret.txt", sig, expireUnix); err == nil {
+        t.Fatal("expected DELETE to be rejected regardless of scope")
+    }
+}
+
+func TestVerifyPresignedRequestRejectsMismatchedScope(t *testing.T) {
+    expireUnix := time.Now().Unix() + 60
+
+    sig := SignPresignedRequest("GET", "mybucket", "secret.txt", expireUnix)
+
+    if err := VerifyPresignedRequest("PUT", "mybucket", "secret.txt", sig, expireUnix); err == nil {
+        t.Fatal("expected GET-only signature to reject a PUT request")
+    }
+}
+
+func TestVerifyPresignedRequestRejectsExpired(t *testing.T) {
+    expireUnix := time.Now().Unix() - 1
+
+    sig := SignPresignedRequest("GET", "mybucket", "secret.txt", expireUnix)
+
+    if err := VerifyPresignedRequest("GET", "mybucket", "secret.txt", sig, expireUnix); err == nil {
+        t.Fatal("expected expired presigned URL to be rejected")
+    }
+}
@@ -0,0 +1,280 @@
+package buckets
+
+import (
+    "encoding/json"
+    "errors"
+    "regexp"
+
+    "github.com/google/uuid"
+
+    bolt "github.com/coreos/bbolt"
+)
+
+
+const DB_NAME = "gofileserver_buckets.db"
+const BUCKETS_BUCKET = "BucketsBucket"
+
+
+// Bit-flag ACL describing what a granted user may do with a bucket.
+type ACL uint32
+
+const (
+    ACLRead   ACL = 1 << 0
+    ACLWrite  ACL = 1 << 1
+)
+
+
+// A named, shared space of files. The owner always has full access; other
+// users only have whatever bits are present in Grants.
+type Bucket struct {
+    ID       string          `json:"id"`
+    Name     string          `json:"name"`
+    OwnerID  string          `json:"ownerID"`
+    Grants   map[string]ACL  `json:"grants"`
+}
+
+
+func init() {
+
+    // Create database and bucket for Buckets
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+
+    tx, err := db.Begin(true)
+    if err != nil {
+        panic(err)
+    }
+    defer tx.Rollback()
+
+    _, err = tx.CreateBucketIfNotExists([]byte(BUCKETS_BUCKET))
+    if err != nil {
+        panic(err)
+    }
+
+    if err = tx.Commit(); err != nil {
+        panic(err)
+    }
+
+    db.Close()
+}
+
+
+// Bucket names must be between 3 and 40 alphanumeric characters (hyphens and underscores allowed).
+var validNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{3,40}$`)
+
+
+// Creates a new bucket with the given name, owned by ownerID.
+func CreateBucket(name string, ownerID string) (*Bucket, error) {
+
+    if !validNameRegex.MatchString(name) {
+        return nil, errors.New("bucket name must be 3 to 40 alphanumeric characters (hyphens and underscores allowed)")
+    }
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    bucket := Bucket{
+        ID: uuid.New().String(),
+        Name: name,
+        OwnerID: ownerID,
+        Grants: make(map[string]ACL),
+    }
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(BUCKETS_BUCKET))
+
+        if b.Get([]byte(name)) != nil {
+            return errors.New("bucket name already taken")
+        }
+
+        encoded, err := json.Marshal(bucket)
+        if err != nil {
+            return err
+        }
+
+        return b.Put([]byte(name), encoded)
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &bucket, nil
+}
+
+
+// Returns the bucket with the given name.
+func GetBucket(name string) (*Bucket, error) {
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    var bucket Bucket
+
+    err = db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(BUCKETS_BUCKET))
+
+        v := b.Get([]byte(name))
+        if v == nil {
+            return errors.New("bucket not found")
+        }
+
+        return json.Unmarshal(v, &bucket)
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &bucket, nil
+}
+
+
+// Returns the private, single-owner bucket auto-provisioned for a user on first
+// access to their un-namespaced file space, creating it if it doesn't exist yet.
+// Its ID and name are both the user's own ID, so it addresses exactly the files
+// that existed for this user before buckets were introduced.
+func EnsureDefaultBucket(userID string) (*Bucket, error) {
+
+    if existing, err := GetBucket(userID); err == nil {
+        return existing, nil
+    }
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    bucket := Bucket{
+        ID: userID,
+        Name: userID,
+        OwnerID: userID,
+        Grants: make(map[string]ACL),
+    }
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(BUCKETS_BUCKET))
+
+        // someone may have raced us to create it
+        if b.Get([]byte(userID)) != nil {
+            return nil
+        }
+
+        encoded, err := json.Marshal(bucket)
+        if err != nil {
+            return err
+        }
+
+        return b.Put([]byte(userID), encoded)
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    return GetBucket(userID)
+}
+
+
+// Lists the buckets a user owns or has been granted any access to.
+func ListBucketsForUser(userID string) ([]Bucket, error) {
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    matching := make([]Bucket, 0)
+
+    err = db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(BUCKETS_BUCKET))
+
+        return b.ForEach(func(k, v []byte) error {
+            var bucket Bucket
+            if err := json.Unmarshal(v, &bucket); err != nil {
+                return err
+            }
+
+            if bucket.OwnerID == userID {
+                matching = append(matching, bucket)
+                return nil
+            }
+
+            if _, granted := bucket.Grants[userID]; granted {
+                matching = append(matching, bucket)
+            }
+
+            return nil
+        })
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    return matching, nil
+}
+
+
+// Grants (or, if acl is 0, revokes) the given ACL bits to granteeID on a bucket.
+// Only the bucket's owner may call this.
+func SetGrant(bucketName string, requesterID string, granteeID string, acl ACL) error {
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(BUCKETS_BUCKET))
+
+        v := b.Get([]byte(bucketName))
+        if v == nil {
+            return errors.New("bucket not found")
+        }
+
+        var bucket Bucket
+        if err := json.Unmarshal(v, &bucket); err != nil {
+            return err
+        }
+
+        if bucket.OwnerID != requesterID {
+            return errors.New("only the bucket owner can modify its ACLs")
+        }
+
+        if acl == 0 {
+            delete(bucket.Grants, granteeID)
+        } else {
+            bucket.Grants[granteeID] = acl
+        }
+
+        encoded, err := json.Marshal(bucket)
+        if err != nil {
+            return err
+        }
+
+        return b.Put([]byte(bucketName), encoded)
+    })
+}
+
+
+// Returns the effective ACL bits userID has on the given bucket: full access if
+// they're the owner, otherwise whatever has been explicitly granted (0 if none).
+func EffectiveACL(bucket *Bucket, userID string) ACL {
+    if bucket.OwnerID == userID {
+        return ACLRead | ACLWrite
+    }
+    return bucket.Grants[userID]
+}
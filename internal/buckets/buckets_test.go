@@ -0,0 +1,33 @@
+package buckets
+
+import "testing"
+
+func TestEffectiveACLOwnerHasFullAccess(t *testing.T) {
+    bucket := &Bucket{OwnerID: "alice", Grants: map[string]ACL{}}
+
+    if got := EffectiveACL(bucket, "alice"); got != ACLRead|ACLWrite {
+        t.Fatalf("expected owner to have read+write, got %v", got)
+    }
+}
+
+func TestEffectiveACLUsesGrantedBits(t *testing.T) {
+    bucket := &Bucket{
+        OwnerID: "alice",
+        Grants:  map[string]ACL{"bob": ACLWrite},
+    }
+
+    if got := EffectiveACL(bucket, "bob"); got != ACLWrite {
+        t.Fatalf("expected bob to have write-only, got %v", got)
+    }
+    if got := EffectiveACL(bucket, "bob"); got&ACLRead != 0 {
+        t.Fatalf("expected bob to not have read, got %v", got)
+    }
+}
+
+func TestEffectiveACLUngrantedUserHasNoAccess(t *testing.T) {
+    bucket := &Bucket{OwnerID: "alice", Grants: map[string]ACL{}}
+
+    if got := EffectiveACL(bucket, "mallory"); got != 0 {
+        t.Fatalf("expected no grant to mean no access, got %v", got)
+    }
+}
@@ -1,12 +1,17 @@
 package files
 
 import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
     "errors"
     "fmt"
+    "io"
+    "time"
 
     "github.com/google/uuid"
-    
+
     bolt "github.com/coreos/bbolt"
 )
 
@@ -14,24 +19,87 @@ import (
 const DB_NAME = "gofileserver_files.db"
 const USERDATA_BUCKET = "UserFileBucket"
 const FILES_BUCKET = "FileBucket"
+const UPLOADS_BUCKET = "UploadSessionBucket"
+
+// Per-part size limit for chunked/resumable uploads.
+const MAX_PART_UPLOAD = 5 * 1024 * 1024
+
+// Overall size ceiling for a file assembled by CompleteUpload, enforced across all
+// of an upload session's parts combined.
+const MAX_ASSEMBLED_FILE_SIZE = 256 * 1024 * 1024
+
+// Files are stored in FILES_BUCKET split into fixed-size chunks so that GetFile/PutFile
+// never have to hold an entire file in memory at once.
+const CHUNK_SIZE = 1 << 20 // 1 MiB
+
+// Single long-lived handle to DB_NAME, opened once in init() and reused by every
+// function below. bbolt's Open takes an exclusive flock for the life of the handle
+// regardless of read/write transaction type, so opening a fresh *bolt.DB per call
+// (as a reader, e.g. chunkReader) would serialize the whole service behind it.
+var db *bolt.DB
 
 
 type FileMetadata struct {
     ID            string  `json:"id"`
     ContentType   string  `json:"contentType"`
     ContentLength int     `json:"contentLength"`
+    SHA256        string  `json:"sha256"`
+
+    // Version is a random UUID rotated on every write, used for optimistic
+    // concurrency control (see PutFile's prevVersion parameter).
+    Version    string  `json:"version"`
+
+    // Encrypted marks a file as an opaque, client-encrypted blob (e.g. vault
+    // entries). The server never inspects such bytes; it only stores them.
+    Encrypted  bool    `json:"encrypted"`
+}
+
+// Returned by PutFile when prevVersion is given but doesn't match the file's
+// current stored Version, so the caller can merge against CurrentVersion and retry.
+type VersionConflictError struct {
+    CurrentVersion string
+}
+
+func (e *VersionConflictError) Error() string {
+    return "version conflict"
 }
 
 type UserData struct {
     Files  map[string]FileMetadata   `json:"files"`
 }
 
+// A single part of an in-progress chunked upload.
+type UploadedPart struct {
+    Number  int     `json:"number"`
+    SHA256  string  `json:"sha256"`
+    Length  int     `json:"length"`
+}
+
+// Tracks an in-progress resumable, multi-part upload.
+type UploadSession struct {
+    ID           string          `json:"id"`
+    BucketID     string          `json:"bucketID"`
+    Path         string          `json:"path"`
+    ContentType  string          `json:"contentType"`
+    CreatedAt    time.Time       `json:"createdAt"`
+    Parts        []UploadedPart  `json:"parts"`
+}
+
+// A single entry of the part list given to CompleteUpload, identifying a part
+// by number and the SHA256 hash it was uploaded with.
+type PartSpec struct {
+    Number  int     `json:"n"`
+    SHA256  string  `json:"sha256"`
+}
+
 
 func init() {
 
-    // Create database and buckets for Files and UserFiles
+    // Open the database once for the lifetime of the process and create the
+    // buckets for Files and UserFiles.
 
-    db, err := bolt.Open(DB_NAME, 0600, nil)
+    var err error
+    db, err = bolt.Open(DB_NAME, 0600, nil)
     if err != nil {
         panic(err)
     }
@@ -54,30 +122,26 @@ func init() {
         panic(err)
     }
 
-    if err = tx.Commit(); err != nil {
+    _, err = tx.CreateBucketIfNotExists([]byte(UPLOADS_BUCKET))
+    if err != nil {
         panic(err)
     }
 
-    db.Close()
-}
-
-
-// Returns an array of filenames as strings for the given user.
-func ListFilenames(userID string) (filenames []string) {
-
-    db, err := bolt.Open(DB_NAME, 0600, nil)
-    if err != nil {
+    if err = tx.Commit(); err != nil {
         panic(err)
     }
-    defer db.Close()
+}
 
 
-    err = db.View(func(tx *bolt.Tx) error {
+// Returns an array of filenames as strings within the given bucket.
+func ListFilenames(bucketID string) (filenames []string) {
+
+    db.View(func(tx *bolt.Tx) error {
         userFilesBucket := tx.Bucket([]byte(USERDATA_BUCKET))
 
         var userData UserData
 
-        v := userFilesBucket.Get([]byte(userID))
+        v := userFilesBucket.Get([]byte(bucketID))
         if v == nil {
             //no user implies no file either
             return errors.New("user not found")
@@ -104,23 +168,111 @@ func ListFilenames(userID string) (filenames []string) {
 }
 
 
-// Feturns, for the given filename in the user's space, the raw bytes and saved contentType value.
-func GetFile(userID string, filename string) (bytes []byte, contentType string, present bool) {
+// Streams chunks of a single chunked file out of FILES_BUCKET, holding a
+// read-only bolt transaction (against the shared, long-lived db handle) open
+// for the reader's lifetime. Supports seeking to a chunk boundary (and byte
+// offset within it) to serve Range requests.
+type chunkReader struct {
+    tx          *bolt.Tx
+    fileID      string
+    numChunks   int
+    chunkIndex  int
+    current     *bytes.Reader
+}
 
-    db, err := bolt.Open(DB_NAME, 0600, nil)
+func newChunkReader(fileID string, contentLength int) (*chunkReader, error) {
+    tx, err := db.Begin(false)
     if err != nil {
-        panic(err)
+        return nil, err
+    }
+
+    return &chunkReader{
+        tx:        tx,
+        fileID:    fileID,
+        numChunks: (contentLength + CHUNK_SIZE - 1) / CHUNK_SIZE,
+    }, nil
+}
+
+func (r *chunkReader) loadChunk(index int) error {
+    filesBucket := r.tx.Bucket([]byte(FILES_BUCKET))
+
+    chunk := filesBucket.Get(compositeKey(r.fileID, index))
+    if chunk == nil {
+        return errors.New("missing file chunk")
     }
-    defer db.Close()
 
-    contentType = ""
+    // copy out: bytes returned by Get are only valid for the life of the transaction
+    data := make([]byte, len(chunk))
+    copy(data, chunk)
+
+    r.current = bytes.NewReader(data)
+    return nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+    for {
+        if r.current != nil {
+            n, err := r.current.Read(p)
+            if n > 0 {
+                return n, nil
+            }
+            if err != nil && err != io.EOF {
+                return 0, err
+            }
+            r.current = nil
+        }
+
+        if r.chunkIndex >= r.numChunks {
+            return 0, io.EOF
+        }
+
+        if err := r.loadChunk(r.chunkIndex); err != nil {
+            return 0, err
+        }
+        r.chunkIndex++
+    }
+}
 
-    err = db.View(func(tx *bolt.Tx) error {
+// Seek only supports io.SeekStart, which is all doFilesGet needs to honor Range requests.
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+    if whence != io.SeekStart {
+        return 0, errors.New("unsupported seek")
+    }
+
+    index := int(offset / CHUNK_SIZE)
+    within := offset % CHUNK_SIZE
+
+    r.current = nil
+    r.chunkIndex = index
+
+    if index < r.numChunks {
+        if err := r.loadChunk(index); err != nil {
+            return 0, err
+        }
+        if _, err := r.current.Seek(within, io.SeekStart); err != nil {
+            return 0, err
+        }
+        r.chunkIndex++
+    }
+
+    return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+    return r.tx.Rollback()
+}
+
+
+// Returns, for the given filename within the given bucket, a seekable stream of its
+// bytes and its metadata. The caller must Close the returned reader.
+func GetFile(bucketID string, filename string) (reader io.ReadSeekCloser, metadata FileMetadata, present bool) {
+
+    err := db.View(func(tx *bolt.Tx) error {
         userFilesBucket := tx.Bucket([]byte(USERDATA_BUCKET))
 
         var userData UserData
 
-        v := userFilesBucket.Get([]byte(userID))
+        v := userFilesBucket.Get([]byte(bucketID))
         if v == nil {
             //no user implies no file either
             return errors.New("user not found")
@@ -132,37 +284,36 @@ func GetFile(userID string, filename string) (bytes []byte, contentType string,
         }
 
         fileMetadata, present := userData.Files[filename]
-
         if !present {
             return errors.New("file not found")
         }
 
-        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
-
-        bucketBytes := filesBucket.Get([]byte(fileMetadata.ID))
-
-        //copy bytes...
-        bytes = make([]byte, len(bucketBytes))
-        copy(bytes, bucketBytes)
-
-        contentType = fileMetadata.ContentType
-
+        metadata = fileMetadata
         return nil
     })
 
-    present = (err == nil)
-    return bytes, contentType, present
-}
-
-
-// Saves the given file into the user's space.
-func PutFile(userID string, filename string, contentType string, bytes []byte) error {
+    if err != nil {
+        return nil, FileMetadata{}, false
+    }
 
-    db, err := bolt.Open(DB_NAME, 0600, nil)
+    chunkReader, err := newChunkReader(metadata.ID, metadata.ContentLength)
     if err != nil {
-        panic(err)
+        return nil, FileMetadata{}, false
     }
-    defer db.Close()
+
+    return chunkReader, metadata, true
+}
+
+
+// Saves the given file into the given bucket, streaming it in from reader in
+// fixed-size chunks rather than buffering the whole body in memory. Returns the
+// number of bytes written and the file's newly rotated Version.
+//
+// If prevVersion is non-empty, the write only succeeds when it matches the
+// file's current stored Version (empty if the file doesn't exist yet);
+// otherwise it fails with a *VersionConflictError carrying the actual current
+// version, so the caller can merge and retry.
+func PutFile(bucketID string, filename string, contentType string, reader io.Reader, encrypted bool, prevVersion string) (written int, version string, err error) {
 
     err = db.Update(func(tx *bolt.Tx) error {
 
@@ -170,7 +321,7 @@ func PutFile(userID string, filename string, contentType string, bytes []byte) e
 
         var userData UserData
 
-        v := userFilesBucket.Get([]byte(userID))
+        v := userFilesBucket.Get([]byte(bucketID))
         if v != nil {
             //user already has an entry
             if err := json.Unmarshal(v, &userData); err != nil {
@@ -182,62 +333,99 @@ func PutFile(userID string, filename string, contentType string, bytes []byte) e
             userData.Files = make(map[string]FileMetadata)
         }
 
-        fileMetadata, present := userData.Files[filename]
-        if present {
-            fileMetadata.ContentType = contentType
-            fileMetadata.ContentLength = len(bytes)
-            userData.Files[filename] = fileMetadata
-        } else {
-            userData.Files[filename] = FileMetadata{
-                ID: uuid.New().String(),
-                ContentType: contentType,
-                ContentLength: len(bytes),
+        existing, hadExisting := userData.Files[filename]
+
+        if prevVersion != "" {
+            currentVersion := ""
+            if hadExisting {
+                currentVersion = existing.Version
+            }
+            if currentVersion != prevVersion {
+                return &VersionConflictError{CurrentVersion: currentVersion}
             }
         }
 
-        // encode to JSON
-        var encoded []byte
-        encoded, err = json.Marshal(userData)
-        if err != nil {
-            return err
+        fileID := uuid.New().String()
+        if hadExisting {
+            fileID = existing.ID
         }
 
-        // put in database
-        err = userFilesBucket.Put([]byte(userID), encoded)
-        if err != nil {
-            return err
+        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
+
+        hasher := sha256.New()
+        chunkBuf := make([]byte, CHUNK_SIZE)
+        chunkIndex := 0
+
+        for {
+            n, readErr := io.ReadFull(reader, chunkBuf)
+            if n > 0 {
+                hasher.Write(chunkBuf[:n])
+                written += n
+
+                chunkCopy := make([]byte, n)
+                copy(chunkCopy, chunkBuf[:n])
+                if err := filesBucket.Put(compositeKey(fileID, chunkIndex), chunkCopy); err != nil {
+                    return err
+                }
+                chunkIndex++
+            }
+            if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+                break
+            }
+            if readErr != nil {
+                return readErr
+            }
         }
 
-        //insert bytes into FilesBucket
-        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
-        err = filesBucket.Put([]byte(userData.Files[filename].ID), bytes)
+        // garbage-collect any chunks left over from a previous, larger version of this file
+        if hadExisting {
+            oldNumChunks := (existing.ContentLength + CHUNK_SIZE - 1) / CHUNK_SIZE
+            for i := chunkIndex; i < oldNumChunks; i++ {
+                if err := filesBucket.Delete(compositeKey(fileID, i)); err != nil {
+                    return err
+                }
+            }
+        }
+
+        version = uuid.New().String()
+
+        userData.Files[filename] = FileMetadata{
+            ID: fileID,
+            ContentType: contentType,
+            ContentLength: written,
+            SHA256: hex.EncodeToString(hasher.Sum(nil)),
+            Version: version,
+            Encrypted: encrypted,
+        }
+
+        // encode to JSON
+        encoded, err := json.Marshal(userData)
         if err != nil {
             return err
         }
 
-        return nil
+        // put in database
+        return userFilesBucket.Put([]byte(bucketID), encoded)
     })
 
-    return err
+    if err != nil {
+        return 0, "", err
+    }
+
+    return written, version, nil
 }
 
 
-// Deletes the given file from the user's space.
-func DeleteFile(userID string, filename string) error {
+// Deletes the given file from the given bucket.
+func DeleteFile(bucketID string, filename string) error {
 
-    db, err := bolt.Open(DB_NAME, 0600, nil)
-    if err != nil {
-        panic(err)
-    }
-    defer db.Close()
-
-    err = db.Update(func(tx *bolt.Tx) error {
+    err := db.Update(func(tx *bolt.Tx) error {
 
         userFilesBucket := tx.Bucket([]byte(USERDATA_BUCKET))
 
         var userData UserData
 
-        v := userFilesBucket.Get([]byte(userID))
+        v := userFilesBucket.Get([]byte(bucketID))
         if v == nil {
             // no user, can't delete file
             return nil
@@ -252,28 +440,28 @@ func DeleteFile(userID string, filename string) error {
             return errors.New("file not found")
         }
 
-        // save fileID to delete from FilesBucket
+        // save fileID/chunk count to delete from FilesBucket
         fileID := fileMetadata.ID
+        numChunks := (fileMetadata.ContentLength + CHUNK_SIZE - 1) / CHUNK_SIZE
         delete(userData.Files, filename)
 
         // encode to JSON
-        var encoded []byte
-        encoded, err = json.Marshal(userData)
+        encoded, err := json.Marshal(userData)
         if err != nil {
             return err
         }
 
         // update database
-        err = userFilesBucket.Put([]byte(userID), encoded)
-        if err != nil {
+        if err := userFilesBucket.Put([]byte(bucketID), encoded); err != nil {
             return err
         }
 
-        // delete actual file data from FilesBucket
+        // delete actual file chunks from FilesBucket
         filesBucket := tx.Bucket([]byte(FILES_BUCKET))
-        err = filesBucket.Delete([]byte(fileID))
-        if err != nil {
-            return err
+        for i := 0; i < numChunks; i++ {
+            if err := filesBucket.Delete(compositeKey(fileID, i)); err != nil {
+                return err
+            }
         }
 
         return nil
@@ -284,3 +472,269 @@ func DeleteFile(userID string, filename string) error {
 
 
 
+
+// Synthetic FILES_BUCKET key used both for a completed file's chunks (keyed by
+// fileID/chunkIndex) and for a part of an in-progress upload (keyed by uploadID/partNumber).
+func compositeKey(id string, index int) []byte {
+    return []byte(fmt.Sprintf("%s/%d", id, index))
+}
+
+
+// Begins a new resumable, multi-part upload of a file into the given bucket,
+// returning the new upload's ID.
+func CreateUploadSession(bucketID string, filename string, contentType string) (uploadID string, err error) {
+
+    uploadID = uuid.New().String()
+
+    session := UploadSession{
+        ID: uploadID,
+        BucketID: bucketID,
+        Path: filename,
+        ContentType: contentType,
+        CreatedAt: time.Now(),
+        Parts: make([]UploadedPart, 0),
+    }
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        encoded, err := json.Marshal(session)
+        if err != nil {
+            return err
+        }
+        uploadsBucket := tx.Bucket([]byte(UPLOADS_BUCKET))
+        return uploadsBucket.Put([]byte(uploadID), encoded)
+    })
+
+    if err != nil {
+        return "", err
+    }
+
+    return uploadID, nil
+}
+
+
+// Stores a single part's bytes for an in-progress upload targeting bucketID, recording
+// its SHA256 hash. Re-uploading the same partNumber replaces the previously stored part.
+func PutPart(bucketID string, uploadID string, partNumber int, data []byte) (sha256Hex string, err error) {
+
+    if len(data) > MAX_PART_UPLOAD {
+        return "", errors.New("part exceeds maximum part size")
+    }
+
+    sum := sha256.Sum256(data)
+    sha256Hex = hex.EncodeToString(sum[:])
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        uploadsBucket := tx.Bucket([]byte(UPLOADS_BUCKET))
+
+        v := uploadsBucket.Get([]byte(uploadID))
+        if v == nil {
+            return errors.New("upload session not found")
+        }
+
+        var session UploadSession
+        if err := json.Unmarshal(v, &session); err != nil {
+            return err
+        }
+        if session.BucketID != bucketID {
+            return errors.New("upload session not found")
+        }
+
+        replaced := false
+        for i, part := range session.Parts {
+            if part.Number == partNumber {
+                session.Parts[i] = UploadedPart{Number: partNumber, SHA256: sha256Hex, Length: len(data)}
+                replaced = true
+                break
+            }
+        }
+        if !replaced {
+            session.Parts = append(session.Parts, UploadedPart{Number: partNumber, SHA256: sha256Hex, Length: len(data)})
+        }
+
+        encoded, err := json.Marshal(session)
+        if err != nil {
+            return err
+        }
+        if err := uploadsBucket.Put([]byte(uploadID), encoded); err != nil {
+            return err
+        }
+
+        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
+        return filesBucket.Put(compositeKey(uploadID, partNumber), data)
+    })
+
+    if err != nil {
+        return "", err
+    }
+
+    return sha256Hex, nil
+}
+
+
+// Validates the given part list against what was uploaded (part numbers must be in
+// strictly ascending order, and the total assembled size must not exceed
+// MAX_ASSEMBLED_FILE_SIZE), concatenates the parts into the final file, updates the
+// user's file metadata, and garbage-collects the temporary part data and the upload
+// session.
+func CompleteUpload(bucketID string, uploadID string, parts []PartSpec) error {
+
+    return db.Update(func(tx *bolt.Tx) error {
+        uploadsBucket := tx.Bucket([]byte(UPLOADS_BUCKET))
+
+        v := uploadsBucket.Get([]byte(uploadID))
+        if v == nil {
+            return errors.New("upload session not found")
+        }
+
+        var session UploadSession
+        if err := json.Unmarshal(v, &session); err != nil {
+            return err
+        }
+        if session.BucketID != bucketID {
+            return errors.New("upload session not found")
+        }
+
+        if len(parts) != len(session.Parts) {
+            return errors.New("part list does not match uploaded parts")
+        }
+
+        for i, spec := range parts {
+            if i > 0 && spec.Number <= parts[i-1].Number {
+                return errors.New("parts must be listed in ascending order")
+            }
+        }
+
+        byNumber := make(map[int]UploadedPart)
+        for _, part := range session.Parts {
+            byNumber[part.Number] = part
+        }
+
+        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
+
+        var totalSize int
+        for _, part := range session.Parts {
+            totalSize += part.Length
+        }
+        if totalSize > MAX_ASSEMBLED_FILE_SIZE {
+            return errors.New("assembled file exceeds maximum allowed size")
+        }
+
+        var assembled bytes.Buffer
+        assembled.Grow(totalSize)
+        for _, spec := range parts {
+            uploaded, present := byNumber[spec.Number]
+            if !present {
+                return errors.New("missing uploaded part")
+            }
+            if uploaded.SHA256 != spec.SHA256 {
+                return errors.New("part hash mismatch")
+            }
+
+            data := filesBucket.Get(compositeKey(uploadID, spec.Number))
+            if data == nil {
+                return errors.New("part data missing")
+            }
+            assembled.Write(data)
+        }
+
+        finalBytes := assembled.Bytes()
+        sum := sha256.Sum256(finalBytes)
+
+        userFilesBucket := tx.Bucket([]byte(USERDATA_BUCKET))
+
+        var userData UserData
+        uv := userFilesBucket.Get([]byte(session.BucketID))
+        if uv != nil {
+            if err := json.Unmarshal(uv, &userData); err != nil {
+                return err
+            }
+        } else {
+            userData.Files = make(map[string]FileMetadata)
+        }
+
+        existing, hadExisting := userData.Files[session.Path]
+
+        fileID := uuid.New().String()
+        if hadExisting {
+            fileID = existing.ID
+        }
+
+        userData.Files[session.Path] = FileMetadata{
+            ID: fileID,
+            ContentType: session.ContentType,
+            ContentLength: len(finalBytes),
+            SHA256: hex.EncodeToString(sum[:]),
+            Version: uuid.New().String(),
+        }
+
+        encodedUserData, err := json.Marshal(userData)
+        if err != nil {
+            return err
+        }
+        if err := userFilesBucket.Put([]byte(session.BucketID), encodedUserData); err != nil {
+            return err
+        }
+
+        newNumChunks := (len(finalBytes) + CHUNK_SIZE - 1) / CHUNK_SIZE
+        for i := 0; i < newNumChunks; i++ {
+            start := i * CHUNK_SIZE
+            end := start + CHUNK_SIZE
+            if end > len(finalBytes) {
+                end = len(finalBytes)
+            }
+            if err := filesBucket.Put(compositeKey(fileID, i), finalBytes[start:end]); err != nil {
+                return err
+            }
+        }
+
+        // garbage-collect any chunks left over from a previous, larger version of this file
+        if hadExisting {
+            oldNumChunks := (existing.ContentLength + CHUNK_SIZE - 1) / CHUNK_SIZE
+            for i := newNumChunks; i < oldNumChunks; i++ {
+                if err := filesBucket.Delete(compositeKey(fileID, i)); err != nil {
+                    return err
+                }
+            }
+        }
+
+        // garbage-collect the temporary parts and the upload session
+        for _, spec := range parts {
+            if err := filesBucket.Delete(compositeKey(uploadID, spec.Number)); err != nil {
+                return err
+            }
+        }
+
+        return uploadsBucket.Delete([]byte(uploadID))
+    })
+}
+
+
+// Aborts an in-progress upload targeting bucketID, discarding any uploaded parts.
+func AbortUpload(bucketID string, uploadID string) error {
+
+    return db.Update(func(tx *bolt.Tx) error {
+        uploadsBucket := tx.Bucket([]byte(UPLOADS_BUCKET))
+
+        v := uploadsBucket.Get([]byte(uploadID))
+        if v == nil {
+            return errors.New("upload session not found")
+        }
+
+        var session UploadSession
+        if err := json.Unmarshal(v, &session); err != nil {
+            return err
+        }
+        if session.BucketID != bucketID {
+            return errors.New("upload session not found")
+        }
+
+        filesBucket := tx.Bucket([]byte(FILES_BUCKET))
+        for _, part := range session.Parts {
+            if err := filesBucket.Delete(compositeKey(uploadID, part.Number)); err != nil {
+                return err
+            }
+        }
+
+        return uploadsBucket.Delete([]byte(uploadID))
+    })
+}
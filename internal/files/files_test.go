@@ -0,0 +1,54 @@
+package files
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+
+    "github.com/google/uuid"
+)
+
+func TestPutFileVersionConflict(t *testing.T) {
+    bucketID := uuid.New().String()
+    filename := "conflict.txt"
+
+    _, firstVersion, err := PutFile(bucketID, filename, "text/plain", bytes.NewReader([]byte("v1")), false, "")
+    if err != nil {
+        t.Fatalf("initial PutFile failed: %v", err)
+    }
+
+    // Writing again with a stale prevVersion must fail with a VersionConflictError
+    // carrying the actual current version, not silently overwrite.
+    _, _, err = PutFile(bucketID, filename, "text/plain", bytes.NewReader([]byte("v2-stale")), false, "not-the-real-version")
+
+    var conflict *VersionConflictError
+    if !errors.As(err, &conflict) {
+        t.Fatalf("expected *VersionConflictError, got: %v", err)
+    }
+    if conflict.CurrentVersion != firstVersion {
+        t.Fatalf("expected conflict to report current version %q, got %q", firstVersion, conflict.CurrentVersion)
+    }
+
+    // Writing again with the correct prevVersion must succeed and rotate the version.
+    _, secondVersion, err := PutFile(bucketID, filename, "text/plain", bytes.NewReader([]byte("v2")), false, firstVersion)
+    if err != nil {
+        t.Fatalf("PutFile with correct prevVersion failed: %v", err)
+    }
+    if secondVersion == firstVersion {
+        t.Fatal("expected version to rotate on successful write")
+    }
+}
+
+func TestPutFileNoPrevVersionSkipsCheck(t *testing.T) {
+    bucketID := uuid.New().String()
+    filename := "no-check.txt"
+
+    if _, _, err := PutFile(bucketID, filename, "text/plain", bytes.NewReader([]byte("v1")), false, ""); err != nil {
+        t.Fatalf("initial PutFile failed: %v", err)
+    }
+
+    // An empty prevVersion means "don't check", even once the file already exists.
+    if _, _, err := PutFile(bucketID, filename, "text/plain", bytes.NewReader([]byte("v2")), false, ""); err != nil {
+        t.Fatalf("expected empty prevVersion to skip the conflict check, got: %v", err)
+    }
+}
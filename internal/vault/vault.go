@@ -0,0 +1,94 @@
+package vault
+
+import (
+    "errors"
+
+    bolt "github.com/coreos/bbolt"
+)
+
+
+const DB_NAME = "gofileserver_vault.db"
+const VAULT_BUCKET = "VaultBucket"
+
+
+func init() {
+
+    // Create database and bucket for Vaults
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+
+    tx, err := db.Begin(true)
+    if err != nil {
+        panic(err)
+    }
+    defer tx.Rollback()
+
+    _, err = tx.CreateBucketIfNotExists([]byte(VAULT_BUCKET))
+    if err != nil {
+        panic(err)
+    }
+
+    if err = tx.Commit(); err != nil {
+        panic(err)
+    }
+
+    db.Close()
+}
+
+
+// Stores (or overwrites) the given user's vault blob: an opaque, client-encrypted
+// key-wrapping payload (e.g. a scrypt-derived key check plus a wrapped master key).
+// The server never inspects or decrypts this data.
+func InitVault(userID string, blob []byte) error {
+
+    if len(blob) == 0 {
+        return errors.New("vault blob required")
+    }
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    return db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(VAULT_BUCKET))
+        return b.Put([]byte(userID), blob)
+    })
+}
+
+
+// Returns the given user's vault blob.
+func GetVault(userID string) ([]byte, error) {
+
+    db, err := bolt.Open(DB_NAME, 0600, nil)
+    if err != nil {
+        panic(err)
+    }
+    defer db.Close()
+
+    var blob []byte
+
+    err = db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(VAULT_BUCKET))
+
+        v := b.Get([]byte(userID))
+        if v == nil {
+            return errors.New("vault not found")
+        }
+
+        // copy out: bytes returned by Get are only valid for the life of the transaction
+        blob = make([]byte, len(v))
+        copy(blob, v)
+        return nil
+    })
+
+    if err != nil {
+        return nil, err
+    }
+
+    return blob, nil
+}